@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/addisonj/ws-relay/pool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+func main() {
+	logger := zap.Must(zap.NewProduction()).Sugar()
+	defer logger.Sync()
+	if os.Getenv("APP_ENV") == "development" {
+		logger = zap.Must(zap.NewDevelopment()).Sugar()
+	}
+
+	var (
+		listen string
+		ttl    time.Duration
+		geoDB  string
+	)
+	flag.StringVar(&listen, "listen", ":8081", "address to listen on")
+	flag.DurationVar(&ttl, "relay-ttl", 90*time.Second, "how long a relay registration stays valid without a refresh")
+	flag.StringVar(&geoDB, "geoip-db", "", "path to a MaxMind GeoIP2/GeoLite2 City database (optional, no-op when unset)")
+	flag.Parse()
+
+	var geoIP pool.GeoIP
+	if geoDB != "" {
+		mm, err := pool.NewMaxMindGeoIP(geoDB)
+		if err != nil {
+			logger.Fatalw("Failed to open GeoIP database", "path", geoDB, "error", err)
+		}
+		defer mm.Close()
+		geoIP = mm
+	}
+
+	server := pool.NewServer(ttl, geoIP)
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "wsrelaypool_relays_active",
+		Help: "The number of relay instances currently registered with the pool",
+	}, func() float64 {
+		return float64(len(server.Endpoints()))
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "wsrelaypool_relay_sessions_active",
+		Help: "The aggregate active session count reported across all registered relays",
+	}, func() float64 {
+		total := 0.0
+		for _, e := range server.Endpoints() {
+			total += float64(e.Stats.ActiveSessions)
+		}
+		return total
+	})
+
+	http.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var reg pool.Registration
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if reg.URL == "" {
+			http.Error(w, "url is required", http.StatusBadRequest)
+			return
+		}
+
+		server.Register(reg, r.RemoteAddr)
+		logger.Infow("Registered relay", "url", reg.URL, "capacity", reg.Capacity, "version", reg.Version)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	http.HandleFunc("/endpoint", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(server.Endpoints())
+	})
+
+	http.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		ticker := time.NewTicker(ttl)
+		defer ticker.Stop()
+		for range ticker.C {
+			server.Sweep()
+		}
+	}()
+
+	logger.Infow("Started relay pool server", "listen", listen)
+	if err := http.ListenAndServe(listen, nil); err != nil {
+		logger.Fatalw("Pool server stopped", "error", err)
+	}
+}
@@ -1,18 +1,51 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"github.com/oklog/ulid/v2"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/acme/autocert"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/olahol/melody"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// sessionRequest is the optional JSON body for POST /session. An empty or
+// absent body yields the zero value, i.e. modeSingle with replay disabled.
+type sessionRequest struct {
+	Mode   string `json:"mode"`
+	Replay int    `json:"replay"`
+}
+
 type tokenResponse struct {
-	Token string `json:"token"`
+	Token  string `json:"token"`
+	Mode   string `json:"mode"`
+	Replay int    `json:"replay,omitempty"`
+}
+
+// parseMode maps the sessionRequest.Mode string to a Mode, defaulting to
+// modeSingle when unset.
+func parseMode(s string) (Mode, error) {
+	switch s {
+	case "", "single":
+		return modeSingle, nil
+	case "fanout":
+		return modeFanout, nil
+	default:
+		return modeSingle, fmt.Errorf("unknown mode %q", s)
+	}
 }
 
 func main() {
@@ -22,7 +55,39 @@ func main() {
 		logger = zap.Must(zap.NewDevelopment()).Sugar()
 	}
 
-	relay := NewWSRelay(logger)
+	authToken := os.Getenv("WSRELAY_AUTH_TOKEN")
+	flag.StringVar(&authToken, "auth-token", authToken, "shared secret required to create or attach to sessions (default: auth disabled)")
+	poolURL := flag.String("pool-url", "", "relay-pool server to register this relay with (default: pool registration disabled)")
+	publicURL := flag.String("public-url", "", "this relay's externally reachable base URL, reported to the relay pool")
+	capacity := flag.Int("capacity", 0, "a hint of this relay's maximum session capacity, reported to the relay pool")
+
+	var rateLimit RateLimitConfig
+	flag.Float64Var(&rateLimit.SessionsPerMinute, "ratelimit-sessions-per-minute", 0, "max new sessions per minute across the relay (0 disables)")
+	flag.Float64Var(&rateLimit.BytesPerSecondPerToken, "ratelimit-bytes-per-second-per-token", 0, "max sustained bytes/sec per token's SendData stream (0 disables)")
+	flag.IntVar(&rateLimit.BurstBytes, "ratelimit-burst-bytes", 0, "burst allowance above ratelimit-bytes-per-second-per-token (default: equal to the rate; never less than 4096)")
+
+	listenAddr := flag.String("listen", ":8080", "address to listen on; serves TLS when -tls-cert/-tls-key or -acme-domain are set")
+	listenPlain := flag.String("listen-plain", "", "address for a plaintext listener that redirects to https (only useful alongside TLS)")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	acmeDomain := flag.String("acme-domain", "", "domain to obtain a certificate for via Let's Encrypt autocert (overrides -tls-cert/-tls-key)")
+	flag.Parse()
+
+	relay := NewWSRelay(logger, authToken, rateLimit)
+	if relay.AuthToken != "" {
+		logger.Info("Auth token required for session creation and attach")
+	}
+
+	if *poolURL != "" {
+		client := newPoolClient(*poolURL, *publicURL, *capacity, relay, logger)
+		go client.Run(30*time.Second, nil)
+	}
+
+	// shuttingDown is set once graceful shutdown begins, so new /session
+	// requests are rejected while in-flight /session/send requests (tracked
+	// by inFlight) are allowed to drain.
+	var shuttingDown atomic.Bool
+	var inFlight sync.WaitGroup
 
 	// POST /session
 	http.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
@@ -31,11 +96,43 @@ func main() {
 			return
 		}
 
+		if shuttingDown.Load() {
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		if !checkAuth(r, relay.AuthToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if !relay.AllowSession() {
+			http.Error(w, "Too many session requests", http.StatusTooManyRequests)
+			return
+		}
+
+		var req sessionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		mode, err := parseMode(req.Mode)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		token := generateToken() // Replace with your own token generation function
-		relay.RegisterToken(token)
+		relay.RegisterToken(token, mode, req.Replay)
+
+		modeName := "single"
+		if mode == modeFanout {
+			modeName = "fanout"
+		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(tokenResponse{Token: token})
+		json.NewEncoder(w).Encode(tokenResponse{Token: token, Mode: modeName, Replay: req.Replay})
 	})
 
 	// GET /session/receive/:token
@@ -45,6 +142,11 @@ func main() {
 			return
 		}
 
+		if !checkAuth(r, relay.AuthToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
 		token := r.URL.Path[len("/session/receive/"):]
 		err := relay.Melody.HandleRequestWithKeys(w, r, map[string]interface{}{
 			"token": token,
@@ -63,11 +165,26 @@ func main() {
 			return
 		}
 
+		if !checkAuth(r, relay.AuthToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		inFlight.Add(1)
+		defer inFlight.Done()
+
 		token := r.URL.Path[len("/session/send/"):]
-		err := relay.SendData(token, r.Body)
+		err := relay.SendData(r.Context(), token, r.Body)
 
 		if err != nil {
-			http.Error(w, "Error sending data", http.StatusInternalServerError)
+			switch {
+			case errors.Is(err, ErrReceiverGone):
+				http.Error(w, "Receiver gone", http.StatusServiceUnavailable)
+			case errors.Is(err, context.Canceled):
+				http.Error(w, "Client closed request", 499)
+			default:
+				http.Error(w, "Error sending data", http.StatusInternalServerError)
+			}
 			logger.Errorw("Error sending data", "error", err)
 			return
 		}
@@ -101,11 +218,115 @@ func main() {
 			return
 		}
 
-		relay.DisposeToken(token.(string))
+		relay.RemoveSession(token.(string), s)
 	})
 
-	logger.Infow("Started server", "port", "8080")
-	http.ListenAndServe(":8080", nil)
+	srv := &http.Server{
+		Addr:              *listenAddr,
+		ReadHeaderTimeout: 5 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+
+	useTLS := *acmeDomain != "" || (*tlsCert != "" && *tlsKey != "")
+	var certManager *autocert.Manager
+	if *acmeDomain != "" {
+		certManager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(*acmeDomain),
+			Cache:      autocert.DirCache("autocert"),
+		}
+		srv.TLSConfig = certManager.TLSConfig()
+	}
+
+	var plainSrv *http.Server
+	if *listenPlain != "" {
+		if !useTLS {
+			logger.Fatal("-listen-plain requires -tls-cert/-tls-key or -acme-domain to be set")
+		}
+		var redirect http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusMovedPermanently)
+		})
+		if certManager != nil {
+			// Let autocert answer ACME HTTP-01 challenges on the plaintext
+			// listener as well as redirecting everything else to HTTPS.
+			redirect = certManager.HTTPHandler(redirect)
+		}
+		plainSrv = &http.Server{
+			Addr:              *listenPlain,
+			Handler:           redirect,
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		go func() {
+			if err := plainSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Errorw("Plaintext redirect listener stopped", "error", err)
+			}
+		}()
+	}
+
+	ctx, stopNotify := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopNotify()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		var err error
+		switch {
+		case *acmeDomain != "":
+			err = srv.ListenAndServeTLS("", "")
+		case useTLS:
+			err = srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+		default:
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			serveErr <- err
+		}
+		close(serveErr)
+	}()
+
+	logger.Infow("Started server", "listen", *listenAddr, "tls", useTLS)
+
+	select {
+	case <-ctx.Done():
+		logger.Info("Shutdown signal received, draining in-flight requests")
+	case err := <-serveErr:
+		if err != nil {
+			logger.Fatalw("Server failed", "error", err)
+		}
+	}
+
+	// Stop accepting new /session requests before tearing anything else
+	// down, then let in-flight SendData calls finish within the shutdown
+	// window.
+	shuttingDown.Store(true)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Errorw("Error shutting down server", "error", err)
+	}
+	if plainSrv != nil {
+		if err := plainSrv.Shutdown(shutdownCtx); err != nil {
+			logger.Errorw("Error shutting down plaintext redirect listener", "error", err)
+		}
+	}
+
+	// inFlight.Wait() has no deadline of its own, so bound it to the same
+	// shutdown budget - otherwise a stalled SendData call would block the
+	// process from ever exiting.
+	drained := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-shutdownCtx.Done():
+		logger.Warn("Timed out waiting for in-flight requests to drain, closing remaining sessions")
+	}
+	relay.Melody.Close()
+
+	logger.Info("Server stopped")
 }
 
 func generateToken() string {
@@ -0,0 +1,17 @@
+package pool
+
+// GeoIP resolves a remote address to an approximate Location. Lookups are
+// advisory only: implementations should return the zero Location rather
+// than an error when a lookup fails.
+type GeoIP interface {
+	Lookup(remoteAddr string) Location
+}
+
+// NoopGeoIP is the default GeoIP used when no MaxMind database is
+// configured; it always returns the zero Location.
+type NoopGeoIP struct{}
+
+// Lookup always returns the zero Location.
+func (NoopGeoIP) Lookup(remoteAddr string) Location {
+	return Location{}
+}
@@ -0,0 +1,53 @@
+package pool
+
+import (
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// MaxMindGeoIP resolves locations from a MaxMind GeoLite2/GeoIP2 City
+// database.
+type MaxMindGeoIP struct {
+	db *geoip2.Reader
+}
+
+// NewMaxMindGeoIP opens the MaxMind database at path.
+func NewMaxMindGeoIP(path string) (*MaxMindGeoIP, error) {
+	db, err := geoip2.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &MaxMindGeoIP{db: db}, nil
+}
+
+// Lookup resolves remoteAddr (a "host:port" or bare IP) to a Location.
+// Lookup failures resolve to the zero Location rather than an error, since
+// geolocation here is advisory only.
+func (m *MaxMindGeoIP) Lookup(remoteAddr string) Location {
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return Location{}
+	}
+
+	record, err := m.db.City(ip)
+	if err != nil {
+		return Location{}
+	}
+
+	return Location{
+		Lat:     record.Location.Latitude,
+		Lon:     record.Location.Longitude,
+		Country: record.Country.IsoCode,
+	}
+}
+
+// Close releases the underlying database file.
+func (m *MaxMindGeoIP) Close() error {
+	return m.db.Close()
+}
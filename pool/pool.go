@@ -0,0 +1,122 @@
+// Package pool implements the ws-relay relay-pool registration service: a
+// small directory that relay instances periodically register themselves
+// with, so a client that obtained a token from one relay can ask the pool
+// which relay to open its WebSocket against.
+package pool
+
+import (
+	"sync"
+	"time"
+)
+
+// Location is the optional geolocation of a registered relay.
+type Location struct {
+	Lat     float64 `json:"lat"`
+	Lon     float64 `json:"lon"`
+	Country string  `json:"country"`
+}
+
+// Stats is the point-in-time operational snapshot a relay reports about
+// itself.
+type Stats struct {
+	ActiveSessions int64 `json:"activeSessions"`
+	BytesProxied   int64 `json:"bytesProxied"`
+	UptimeSeconds  int64 `json:"uptime"`
+}
+
+// Registration is what a relay instance POSTs to the pool on each
+// check-in.
+type Registration struct {
+	URL      string `json:"url"`
+	Capacity int    `json:"capacity"`
+	Version  string `json:"version"`
+	Stats    Stats  `json:"stats"`
+}
+
+// Endpoint is the public representation of a registered relay, as returned
+// by GET /endpoint.
+type Endpoint struct {
+	URL      string   `json:"url"`
+	Location Location `json:"location"`
+	Stats    Stats    `json:"stats"`
+}
+
+// entry is the pool's internal bookkeeping for a single registered relay.
+type entry struct {
+	registration Registration
+	location     Location
+	expiresAt    time.Time
+}
+
+// Server is an in-memory directory of registered relays with TTL eviction.
+type Server struct {
+	mu     sync.RWMutex
+	relays map[string]*entry
+	ttl    time.Duration
+	geoIP  GeoIP
+}
+
+// NewServer creates a Server whose registrations expire after ttl without a
+// refresh. geoIP may be nil, in which case NoopGeoIP is used and every
+// Endpoint's Location is left zero-valued.
+func NewServer(ttl time.Duration, geoIP GeoIP) *Server {
+	if geoIP == nil {
+		geoIP = NoopGeoIP{}
+	}
+	return &Server{
+		relays: make(map[string]*entry),
+		ttl:    ttl,
+		geoIP:  geoIP,
+	}
+}
+
+// Register records (or refreshes) a relay's registration, keyed by its
+// reported URL. remoteAddr is the registering connection's address, used
+// for GeoIP lookup.
+func (s *Server) Register(reg Registration, remoteAddr string) {
+	loc := s.geoIP.Lookup(remoteAddr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.relays[reg.URL] = &entry{
+		registration: reg,
+		location:     loc,
+		expiresAt:    time.Now().Add(s.ttl),
+	}
+}
+
+// Endpoints returns every relay that has not yet expired.
+func (s *Server) Endpoints() []Endpoint {
+	now := time.Now()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make([]Endpoint, 0, len(s.relays))
+	for _, e := range s.relays {
+		if now.After(e.expiresAt) {
+			continue
+		}
+		out = append(out, Endpoint{
+			URL:      e.registration.URL,
+			Location: e.location,
+			Stats:    e.registration.Stats,
+		})
+	}
+	return out
+}
+
+// Sweep evicts expired relays. Callers should invoke this periodically;
+// Endpoints already filters expired entries, so Sweep only matters for
+// bounding memory use.
+func (s *Server) Sweep() {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for url, e := range s.relays {
+		if now.After(e.expiresAt) {
+			delete(s.relays, url)
+		}
+	}
+}
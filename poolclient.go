@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/addisonj/ws-relay/pool"
+	"go.uber.org/zap"
+)
+
+// Version is the relay build version reported to the relay pool; set via
+// -ldflags at build time, "dev" otherwise.
+var Version = "dev"
+
+// poolClient periodically reports this relay's public URL, capacity, and
+// live stats to a relay-pool server, so clients that obtained a token from
+// this relay can be directed to it by the pool.
+type poolClient struct {
+	poolURL   string
+	publicURL string
+	capacity  int
+	relay     *WSRelay
+	logger    *zap.SugaredLogger
+	client    *http.Client
+}
+
+// newPoolClient creates a poolClient that registers publicURL (this
+// relay's externally reachable base URL) with the relay pool at poolURL.
+func newPoolClient(poolURL, publicURL string, capacity int, relay *WSRelay, logger *zap.SugaredLogger) *poolClient {
+	return &poolClient{
+		poolURL:   poolURL,
+		publicURL: publicURL,
+		capacity:  capacity,
+		relay:     relay,
+		logger:    logger.Named("pool-client"),
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Run registers with the pool immediately, then again every interval until
+// stop is closed.
+func (c *poolClient) Run(interval time.Duration, stop <-chan struct{}) {
+	c.register()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.register()
+		}
+	}
+}
+
+func (c *poolClient) register() {
+	reg := pool.Registration{
+		URL:      c.publicURL,
+		Capacity: c.capacity,
+		Version:  Version,
+		Stats: pool.Stats{
+			ActiveSessions: int64(c.relay.Melody.Len()),
+			BytesProxied:   c.relay.BytesProxied(),
+			UptimeSeconds:  int64(c.relay.Uptime().Seconds()),
+		},
+	}
+
+	body, err := json.Marshal(reg)
+	if err != nil {
+		c.logger.Errorw("Failed to marshal pool registration", "error", err)
+		return
+	}
+
+	resp, err := c.client.Post(c.poolURL+"/register", "application/json", bytes.NewReader(body))
+	if err != nil {
+		c.logger.Errorw("Failed to register with relay pool", "pool_url", c.poolURL, "error", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		c.logger.Errorw("Relay pool rejected registration", "pool_url", c.poolURL, "status", resp.StatusCode)
+	}
+}
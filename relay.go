@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 	"io"
 	"sync"
+	"sync/atomic"
 
 	"github.com/ReneKroon/ttlcache"
 	"github.com/olahol/melody"
@@ -14,6 +17,35 @@ import (
 	"time"
 )
 
+// ErrReceiverGone is returned by SendData when a modeSingle token's
+// WebSocket receiver disconnects before the full body has been relayed. A
+// cancelled request context is reported as ctx.Err() instead.
+var ErrReceiverGone = errors.New("receiver gone")
+
+// sendDataReadBufferSize is the chunk size SendData reads the request body
+// in. Every per-token rate limiter's burst must be at least this large,
+// since WaitN rejects outright (rather than waiting) when asked to wait for
+// more than the limiter's burst.
+const sendDataReadBufferSize = 4 * 1024
+
+// RateLimitConfig configures the token-bucket rate limiters guarding session
+// creation and per-token SendData throughput. A zero value disables both
+// limits.
+type RateLimitConfig struct {
+	// SessionsPerMinute caps how many new sessions may be created across
+	// the whole relay. Zero disables the limit.
+	SessionsPerMinute float64
+	// BytesPerSecondPerToken caps the sustained throughput of a single
+	// token's SendData stream. Zero disables the limit.
+	BytesPerSecondPerToken float64
+	// BurstBytes is the per-token burst allowance above
+	// BytesPerSecondPerToken. Zero defaults to BytesPerSecondPerToken; in
+	// either case it is clamped up to sendDataReadBufferSize so a low
+	// configured rate can't make every SendData read exceed the limiter's
+	// burst and fail outright instead of throttling.
+	BurstBytes int
+}
+
 // WSRelay represents our WebSocket relay service.
 type WSRelay struct {
 	// The cache for active relay connections.
@@ -21,45 +53,73 @@ type WSRelay struct {
 	// Melody instance to manage WebSocket connections.
 	Melody *melody.Melody
 	// Mutex for synchronizing access to the cache
-	mu                   sync.RWMutex
-	logger               *zap.SugaredLogger
-	tokenCounter         prometheus.Counter
-	tokenRemovedCounter  prometheus.Counter
-	messageSizeHistogram prometheus.Histogram
-	tokenBytesCounter    *prometheus.CounterVec
-	tokenMessagesCounter *prometheus.CounterVec
+	mu     sync.RWMutex
+	logger *zap.SugaredLogger
+	// AuthToken is the shared secret required on session creation and
+	// WebSocket attach when non-empty. When empty, auth is disabled.
+	AuthToken                 string
+	rateLimit                 RateLimitConfig
+	sessionLimiter            *rate.Limiter
+	tokenCounter              prometheus.Counter
+	tokenRemovedCounter       prometheus.Counter
+	messageSizeHistogram      prometheus.Histogram
+	tokenBytesCounter         *prometheus.CounterVec
+	tokenMessagesCounter      *prometheus.CounterVec
+	ratelimitThrottledSeconds prometheus.Counter
+	ratelimitRejectedCounter  prometheus.Counter
+	tokenLifetimeHistogram    prometheus.Histogram
+	sessionAttachLatency      prometheus.Histogram
+	// startedAt records when the relay was created, for uptime reporting.
+	startedAt time.Time
+	// bytesProxied is the cumulative count of bytes relayed via SendData,
+	// for operational reporting such as the relay-pool client.
+	bytesProxied atomic.Int64
 }
 
-// NewWSRelay creates a new instance of WSRelay.
-func NewWSRelay(logger *zap.SugaredLogger) *WSRelay {
+// NewWSRelay creates a new instance of WSRelay. authToken is the shared
+// secret required on session creation and WebSocket attach; pass "" to
+// disable auth. rateLimit configures the session-creation and per-token
+// byte-rate limiters; its zero value disables both.
+func NewWSRelay(logger *zap.SugaredLogger, authToken string, rateLimit RateLimitConfig) *WSRelay {
 	tokenRemovedCounter := promauto.NewCounter(prometheus.CounterOpts{
 		Name: "wsrelay_token_disposed_total",
 		Help: "The total number of tokens disposed of",
 	})
 	cache := ttlcache.NewCache()
 	cache.SetTTL(15 * time.Minute)
-	mu := sync.RWMutex{}
-	cache.SetCheckExpirationCallback(func(key string, value interface{}) bool {
-		mu.RLock()
-		defer mu.RUnlock()
-		conn, ok := value.(*wsRelayConn)
-		if !ok {
-			log.Println("Failed to convert cached value to connection for token:", key)
-			tokenRemovedCounter.Inc()
-			return false
-		}
-		if conn.session == nil || conn.session.IsClosed() {
-			log.Println("Session is not active for token:", key)
-			tokenRemovedCounter.Inc()
-			return false // let it expire
+	m := melody.New()
+
+	var sessionLimiter *rate.Limiter
+	if rateLimit.SessionsPerMinute > 0 {
+		burst := int(rateLimit.SessionsPerMinute)
+		if burst < 1 {
+			burst = 1
 		}
-		return true // prevent from expiring
+		sessionLimiter = rate.NewLimiter(rate.Limit(rateLimit.SessionsPerMinute/60), burst)
+	}
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "wsrelay_tokens_active",
+		Help: "The number of tokens currently tracked",
+	}, func() float64 {
+		return float64(cache.Count())
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "wsrelay_sessions_active",
+		Help: "The number of WebSocket sessions currently attached",
+	}, func() float64 {
+		return float64(m.Len())
 	})
 
-	return &WSRelay{
-		cache:  cache,
-		Melody: melody.New(),
-		logger: logger.Named("ws-relay"),
+	r := &WSRelay{
+		cache:          cache,
+		Melody:         m,
+		logger:         logger.Named("ws-relay"),
+		AuthToken:      authToken,
+		rateLimit:      rateLimit,
+		sessionLimiter: sessionLimiter,
+		startedAt:      time.Now(),
 		tokenCounter: promauto.NewCounter(prometheus.CounterOpts{
 			Name: "wsrelay_token_total",
 			Help: "The total number of tokens created",
@@ -78,32 +138,162 @@ func NewWSRelay(logger *zap.SugaredLogger) *WSRelay {
 			Name: "wsrelay_token_messages_total",
 			Help: "The total number of messages per token",
 		}, []string{"token"}),
+		ratelimitThrottledSeconds: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "wsrelay_ratelimit_throttled_seconds_total",
+			Help: "Total seconds SendData callers spent waiting on the per-token byte rate limiter",
+		}),
+		ratelimitRejectedCounter: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "wsrelay_ratelimit_rejected_total",
+			Help: "The total number of session creation requests rejected by the session rate limiter",
+		}),
+		tokenLifetimeHistogram: promauto.NewHistogram(prometheus.HistogramOpts{
+			Name:    "wsrelay_token_lifetime_seconds",
+			Help:    "The lifetime of a token from registration to disposal",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12), // 1s to ~34m
+		}),
+		sessionAttachLatency: promauto.NewHistogram(prometheus.HistogramOpts{
+			Name:    "wsrelay_session_attach_latency_seconds",
+			Help:    "The time between a token's registration and a WebSocket session attaching to it",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 12), // 10ms to ~20s
+		}),
 	}
+
+	// The expiration sweep runs on ttlcache's own background goroutine, so
+	// it must take the real r.mu - not a private lock - to stay
+	// synchronized with RegisterSession/RemoveSession's map access.
+	//
+	// Despite its name, ttlcache's CheckExpirationCallback controls removal,
+	// not survival: returning true expires (removes) the item, and false
+	// touches it and keeps it cached. See cleanjob in
+	// github.com/ReneKroon/ttlcache@v1.7.0/cache.go.
+	cache.SetCheckExpirationCallback(func(key string, value interface{}) bool {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		conn, ok := value.(*wsRelayConn)
+		if !ok {
+			log.Println("Failed to convert cached value to connection for token:", key)
+			tokenRemovedCounter.Inc()
+			return true
+		}
+		if conn.mode == modeFanout {
+			for s := range conn.sessions {
+				if !s.IsClosed() {
+					return false // at least one active subscriber, keep alive
+				}
+			}
+			log.Println("No active fanout subscribers for token:", key)
+			tokenRemovedCounter.Inc()
+			r.observeDisposal(key, conn)
+			return true // expire it
+		}
+		if conn.session == nil || conn.session.IsClosed() {
+			log.Println("Session is not active for token:", key)
+			tokenRemovedCounter.Inc()
+			r.observeDisposal(key, conn)
+			return true // expire it
+		}
+		return false // session still active, keep alive
+	})
+
+	return r
+}
+
+// AllowSession reports whether a new session may be created under the
+// configured SessionsPerMinute limit, incrementing the rejection metric when
+// it is exceeded. Returns true when no session limit is configured.
+func (r *WSRelay) AllowSession() bool {
+	if r.sessionLimiter == nil {
+		return true
+	}
+	if r.sessionLimiter.Allow() {
+		return true
+	}
+	r.ratelimitRejectedCounter.Inc()
+	return false
 }
 
+// Mode controls how many WebSocket sessions may attach to a token.
+type Mode int
+
+const (
+	// modeSingle is the default: exactly one receiver may attach to a
+	// token, and additional attach attempts are rejected.
+	modeSingle Mode = iota
+	// modeFanout broadcasts each SendData chunk to every session
+	// currently attached to the token, optionally replaying buffered
+	// frames to late subscribers.
+	modeFanout
+)
+
 // wsRelayConn represents a single WebSocket relay connection.
 type wsRelayConn struct {
-	// The WebSocket connection.
+	// session is the attached receiver in modeSingle.
 	session *melody.Session
+	// sessions holds every attached receiver in modeFanout.
+	sessions map[*melody.Session]struct{}
+	// mode selects single- vs fan-out-receiver semantics.
+	mode Mode
+	// replay buffers recent frames for late fanout subscribers; nil when
+	// replay is disabled.
+	replay *replayBuffer
+	// limiter throttles this token's SendData throughput; nil when
+	// per-token rate limiting is disabled.
+	limiter *rate.Limiter
+	// createdAt is when the token was registered, used to observe
+	// wsrelay_token_lifetime_seconds and wsrelay_session_attach_latency_seconds.
+	createdAt time.Time
 }
 
-// newWSRelayConn creates a new instance of wsRelayConn.
-func newWSRelayConn(session *melody.Session) *wsRelayConn {
-	return &wsRelayConn{
-		session: session,
+// newWSRelayConn creates a new instance of wsRelayConn. replaySize is only
+// meaningful for modeFanout and, when greater than zero, enables a ring
+// buffer of the last replaySize frames. limiter may be nil to disable
+// per-token rate limiting.
+func newWSRelayConn(mode Mode, replaySize int, limiter *rate.Limiter) *wsRelayConn {
+	conn := &wsRelayConn{
+		mode:      mode,
+		limiter:   limiter,
+		createdAt: time.Now(),
 	}
+	if mode == modeFanout {
+		conn.sessions = make(map[*melody.Session]struct{})
+		if replaySize > 0 {
+			conn.replay = newReplayBuffer(replaySize)
+		}
+	}
+	return conn
 }
 
-// RegisterToken registers a token with an associated connection.
-func (r *WSRelay) RegisterToken(token string) {
+// RegisterToken registers a token with an associated connection using the
+// given mode and optional replay buffer size (0 disables replay). A
+// per-token byte-rate limiter is attached when the relay's RateLimitConfig
+// sets BytesPerSecondPerToken.
+func (r *WSRelay) RegisterToken(token string, mode Mode, replaySize int) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	r.cache.Set(token, newWSRelayConn(nil))
-	r.logger.Infow("Registered token", "token", token)
+
+	var limiter *rate.Limiter
+	if r.rateLimit.BytesPerSecondPerToken > 0 {
+		burst := r.rateLimit.BurstBytes
+		if burst <= 0 {
+			burst = int(r.rateLimit.BytesPerSecondPerToken)
+		}
+		if burst < sendDataReadBufferSize {
+			// SendData reads (and WaitNs) in sendDataReadBufferSize chunks, so a
+			// smaller burst would make WaitN reject every read outright instead
+			// of throttling it.
+			burst = sendDataReadBufferSize
+		}
+		limiter = rate.NewLimiter(rate.Limit(r.rateLimit.BytesPerSecondPerToken), burst)
+	}
+
+	r.cache.Set(token, newWSRelayConn(mode, replaySize, limiter))
+	r.logger.Infow("Registered token", "token", token, "mode", mode, "replay", replaySize)
 	r.tokenCounter.Inc()
 }
 
-// RegisterSession associates a session with an existing token.
+// RegisterSession associates a session with an existing token. In modeFanout
+// the session is added to the set of attached subscribers and immediately
+// replayed any buffered frames; in modeSingle a second attach is rejected.
 func (r *WSRelay) RegisterSession(token string, session *melody.Session) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -119,46 +309,146 @@ func (r *WSRelay) RegisterSession(token string, session *melody.Session) error {
 		return errors.New("failed to convert cached value to connection")
 	}
 
+	r.sessionAttachLatency.Observe(time.Since(conn.createdAt).Seconds())
+
+	if conn.mode == modeFanout {
+		conn.sessions[session] = struct{}{}
+		r.logger.Infow("Registered fanout session for token", "token", token, "subscribers", len(conn.sessions))
+		if conn.replay != nil {
+			for _, frame := range conn.replay.snapshot() {
+				if err := session.Write(frame); err != nil {
+					r.logger.Errorw("Error replaying buffered frame", "token", token, "error", err)
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if conn.session != nil {
+		r.logger.Warnw("Session already registered for token", "token", token)
+		return errors.New("session already registered for token")
+	}
+
 	conn.session = session
 	r.logger.Infow("Registered session for token", "token", token)
 	return nil
 }
 
-func (r *WSRelay) SendData(token string, body io.Reader) error {
+// RemoveSession detaches session from token. In modeFanout the session is
+// simply dropped from the subscriber set so the token (and any other
+// subscribers) remain live; in modeSingle the whole token is disposed, since
+// only one receiver was ever expected.
+func (r *WSRelay) RemoveSession(token string, session *melody.Session) {
+	r.mu.Lock()
+	value, exists := r.cache.Get(token)
+	if !exists {
+		r.mu.Unlock()
+		return
+	}
+
+	conn, ok := value.(*wsRelayConn)
+	if !ok {
+		r.mu.Unlock()
+		return
+	}
+
+	if conn.mode == modeFanout {
+		delete(conn.sessions, session)
+		r.logger.Infow("Removed fanout session for token", "token", token, "subscribers", len(conn.sessions))
+		r.mu.Unlock()
+		return
+	}
+	if conn.session != session {
+		// session was rejected by RegisterSession; leave the attached
+		// receiver's token alone.
+		r.mu.Unlock()
+		return
+	}
+	r.mu.Unlock()
+
+	r.DisposeToken(token)
+}
+
+// lookupConn looks up the wsRelayConn registered for token. The returned
+// conn's session/sessions fields may still be mutated concurrently by
+// RegisterSession/RemoveSession; callers that read them after this returns
+// must take r.mu themselves rather than assuming the snapshot still holds.
+func (r *WSRelay) lookupConn(token string) (*wsRelayConn, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
 	value, exists := r.cache.Get(token)
 	if !exists {
 		r.logger.Warnw("Token not found", "token", token)
-		return errors.New("token not found")
+		return nil, errors.New("token not found")
 	}
 
 	conn, ok := value.(*wsRelayConn)
-	if !ok || conn.session == nil {
+	if !ok {
+		r.logger.Warnw("No session associated with this token", "token", token)
+		return nil, errors.New("no session associated with this token")
+	}
+	return conn, nil
+}
+
+// SendData streams body to the session(s) attached to token, throttling
+// against the token's rate limiter (if any) between chunks. It deliberately
+// avoids holding r.mu for the duration of the stream - in particular across
+// the limiter's WaitN, which can sleep for seconds - so one throttled
+// token's SendData call can't stall every other concurrent SendData call or
+// new /session request on the relay.
+func (r *WSRelay) SendData(ctx context.Context, token string, body io.Reader) error {
+	conn, err := r.lookupConn(token)
+	if err != nil {
+		return err
+	}
+	if conn.mode != modeFanout && conn.session == nil {
 		r.logger.Warnw("No session associated with this token", "token", token)
 		return errors.New("no session associated with this token")
 	}
 
-	buf := make([]byte, 4*1024)
+	buf := make([]byte, sendDataReadBufferSize)
 
 	r.logger.Debugw("Starting send", "token", token)
 	totalBytes := 0
 	count := 0
 	for {
+		select {
+		case <-ctx.Done():
+			r.logger.Warnw("Request context done, stopping send", "token", token, "error", ctx.Err())
+			return ctx.Err()
+		default:
+		}
+
+		if conn.mode != modeFanout && conn.session.IsClosed() {
+			r.logger.Warnw("Receiver session closed, stopping send", "token", token)
+			return ErrReceiverGone
+		}
+
 		count++
 		n, err := body.Read(buf)
 		if n > 0 {
 			r.logger.Debugw("writing bytes", "token", token, "byte_count", n)
 			totalBytes += n
-			err = conn.session.Write(buf[:n])
-			if err != nil {
-				r.logger.Errorw("Error writing data to session", "token", token, "error", err)
-				return err
+			if conn.limiter != nil {
+				waitStart := time.Now()
+				if werr := conn.limiter.WaitN(ctx, n); werr != nil {
+					r.logger.Warnw("Rate limit wait failed", "token", token, "error", werr)
+					return werr
+				}
+				if waited := time.Since(waitStart); waited > 0 {
+					r.ratelimitThrottledSeconds.Add(waited.Seconds())
+				}
+			}
+			if werr := r.writeFrame(conn, token, buf[:n]); werr != nil {
+				r.logger.Errorw("Error writing data to session", "token", token, "error", werr)
+				return werr
 			}
 			r.messageSizeHistogram.Observe(float64(n))
 			r.tokenBytesCounter.WithLabelValues(token).Add(float64(n))
 			r.tokenMessagesCounter.WithLabelValues(token).Inc()
+			r.bytesProxied.Add(int64(n))
 		} else {
 			r.logger.Debugw("got back empty bytes", "token", token)
 
@@ -178,10 +468,83 @@ func (r *WSRelay) SendData(token string, body io.Reader) error {
 	return nil
 }
 
-// DisposeToken removes a token and its associated session.
+// writeFrame delivers chunk to the session(s) attached to conn. In
+// modeFanout it buffers chunk for replay (if enabled) and broadcasts it to
+// every currently attached subscriber; in modeSingle it writes directly to
+// the sole session.
+func (r *WSRelay) writeFrame(conn *wsRelayConn, token string, chunk []byte) error {
+	if conn.mode != modeFanout {
+		return conn.session.Write(chunk)
+	}
+
+	// buf is reused across SendData iterations, so copy before handing the
+	// frame to the replay buffer or a background broadcast.
+	frame := append([]byte(nil), chunk...)
+
+	if conn.replay != nil {
+		conn.replay.push(frame)
+	}
+
+	// conn.sessions is mutated by RegisterSession/RemoveSession under r.mu,
+	// and SendData no longer holds r.mu for the duration of the stream, so
+	// snapshot it under the lock rather than ranging over it directly.
+	r.mu.RLock()
+	sessions := make([]*melody.Session, 0, len(conn.sessions))
+	for s := range conn.sessions {
+		sessions = append(sessions, s)
+	}
+	r.mu.RUnlock()
+
+	if len(sessions) == 0 {
+		return nil
+	}
+
+	r.logger.Debugw("Broadcasting frame to fanout subscribers", "token", token, "subscribers", len(sessions))
+	return r.Melody.BroadcastMultiple(frame, sessions)
+}
+
+// ActiveTokenCount reports the number of tokens currently tracked, for use
+// in operational reporting such as the relay-pool client.
+func (r *WSRelay) ActiveTokenCount() int {
+	return r.cache.Count()
+}
+
+// BytesProxied reports the cumulative number of bytes relayed via SendData
+// since the relay was created, for use in operational reporting such as the
+// relay-pool client.
+func (r *WSRelay) BytesProxied() int64 {
+	return r.bytesProxied.Load()
+}
+
+// Uptime reports how long the relay has been running, for use in
+// operational reporting such as the relay-pool client.
+func (r *WSRelay) Uptime() time.Duration {
+	return time.Since(r.startedAt)
+}
+
+// observeDisposal records a token's lifetime and clears its per-token
+// metric label series. It must be called exactly once per token, from
+// whichever path actually removes it from the cache - DisposeToken or the
+// TTL expiration callback - so tokenBytesCounter/tokenMessagesCounter don't
+// leak unbounded cardinality regardless of how a token goes away.
+func (r *WSRelay) observeDisposal(token string, conn *wsRelayConn) {
+	r.tokenLifetimeHistogram.Observe(time.Since(conn.createdAt).Seconds())
+	r.tokenBytesCounter.DeleteLabelValues(token)
+	r.tokenMessagesCounter.DeleteLabelValues(token)
+}
+
+// DisposeToken removes a token and its associated session, recording its
+// lifetime and clearing its per-token metric label series.
 func (r *WSRelay) DisposeToken(token string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+
+	if value, exists := r.cache.Get(token); exists {
+		if conn, ok := value.(*wsRelayConn); ok {
+			r.observeDisposal(token, conn)
+		}
+	}
+
 	r.cache.Remove(token)
 	r.tokenRemovedCounter.Inc()
 	r.logger.Infow("Disposed token:", "token", token)
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/olahol/melody"
+	"go.uber.org/zap"
+)
+
+// newTestRelayServer wires relay's WebSocket handlers the same way main.go
+// does, for a single fixed token, and returns an httptest server plus a
+// channel that receives a signal every time a session disconnects.
+func newTestRelayServer(t *testing.T, relay *WSRelay, token string) (*httptest.Server, chan struct{}) {
+	t.Helper()
+
+	disconnected := make(chan struct{}, 8)
+
+	relay.Melody.HandleConnect(func(s *melody.Session) {
+		if err := relay.RegisterSession(token, s); err != nil {
+			s.Close()
+		}
+	})
+	relay.Melody.HandleDisconnect(func(s *melody.Session) {
+		relay.RemoveSession(token, s)
+		disconnected <- struct{}{}
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		relay.Melody.HandleRequestWithKeys(w, r, map[string]interface{}{"token": token})
+	}))
+	t.Cleanup(server.Close)
+
+	return server, disconnected
+}
+
+func dialTestServer(t *testing.T, server *httptest.Server) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(server.URL, "http", "ws", 1), nil)
+	if err != nil {
+		t.Fatalf("failed to dial test server: %v", err)
+	}
+	return conn
+}
+
+func fanoutSubscriberCount(t *testing.T, relay *WSRelay, token string) int {
+	t.Helper()
+	relay.mu.RLock()
+	defer relay.mu.RUnlock()
+	value, exists := relay.cache.Get(token)
+	if !exists {
+		t.Fatalf("token %q not found", token)
+	}
+	return len(value.(*wsRelayConn).sessions)
+}
+
+func TestRegisterSessionFanoutSubscriberBookkeeping(t *testing.T) {
+	relay := NewWSRelay(zap.NewNop().Sugar(), "", RateLimitConfig{})
+	const token = "test-token"
+	relay.RegisterToken(token, modeFanout, 0)
+
+	server, disconnected := newTestRelayServer(t, relay, token)
+
+	connA := dialTestServer(t, server)
+	defer connA.Close()
+	connB := dialTestServer(t, server)
+	defer connB.Close()
+
+	waitForSubscriberCount(t, relay, token, 2)
+
+	connA.Close()
+	select {
+	case <-disconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for disconnect")
+	}
+
+	waitForSubscriberCount(t, relay, token, 1)
+}
+
+// waitForSubscriberCount polls the fanout subscriber set, since attach and
+// detach are handled asynchronously by melody's connect/disconnect
+// callbacks.
+func waitForSubscriberCount(t *testing.T, relay *WSRelay, token string, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if got := fanoutSubscriberCount(t, relay, token); got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("subscriber count = %d, want %d", fanoutSubscriberCount(t, relay, token), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
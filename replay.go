@@ -0,0 +1,52 @@
+package main
+
+import "sync"
+
+// replayBuffer is a bounded ring buffer of the most recently sent frames for
+// a fanout token, so a late subscriber can be caught up on attach.
+type replayBuffer struct {
+	mu     sync.Mutex
+	frames [][]byte
+	size   int
+	next   int
+	full   bool
+}
+
+// newReplayBuffer creates a replayBuffer holding the last size frames.
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{
+		frames: make([][]byte, size),
+		size:   size,
+	}
+}
+
+// push appends frame to the ring buffer, evicting the oldest frame once
+// full. frame must not be modified by the caller afterwards.
+func (b *replayBuffer) push(frame []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.size == 0 {
+		return
+	}
+	b.frames[b.next] = frame
+	b.next = (b.next + 1) % b.size
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// snapshot returns the currently buffered frames in the order they were
+// sent.
+func (b *replayBuffer) snapshot() [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.full {
+		out := make([][]byte, b.next)
+		copy(out, b.frames[:b.next])
+		return out
+	}
+	out := make([][]byte, b.size)
+	copy(out, b.frames[b.next:])
+	copy(out[b.size-b.next:], b.frames[:b.next])
+	return out
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReplayBufferSnapshotOrder(t *testing.T) {
+	b := newReplayBuffer(3)
+
+	b.push([]byte("a"))
+	b.push([]byte("b"))
+
+	got := b.snapshot()
+	want := [][]byte{[]byte("a"), []byte("b")}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("snapshot() = %v, want %v", got, want)
+	}
+}
+
+func TestReplayBufferWraparound(t *testing.T) {
+	b := newReplayBuffer(3)
+
+	for _, frame := range []string{"a", "b", "c", "d"} {
+		b.push([]byte(frame))
+	}
+
+	got := b.snapshot()
+	want := [][]byte{[]byte("b"), []byte("c"), []byte("d")}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("snapshot() after wraparound = %v, want %v", got, want)
+	}
+}
+
+func TestReplayBufferZeroSizeDisablesReplay(t *testing.T) {
+	b := newReplayBuffer(0)
+	b.push([]byte("a"))
+
+	if got := b.snapshot(); len(got) != 0 {
+		t.Fatalf("snapshot() = %v, want empty", got)
+	}
+}